@@ -5,46 +5,318 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"math/rand"
 	"net/http"
+	"net/http/httptrace"
 	"os"
+	"os/signal"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+
+	"golang.org/x/time/rate"
 )
 
 var client http.Client
 
+// Valid values for the -logformat flag.
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+	logFormatCSV  = "csv"
+)
+
+// Valid values for the -select flag.
+const (
+	selectRandom     = "random"
+	selectWeighted   = "weighted"
+	selectRoundRobin = "roundrobin"
+)
+
+// target is one entry read from STDIN: the URL to request, its
+// relative weight for -select weighted (1 if the input line had
+// none), and the method/body to request it with (the -method and
+// -body defaults, unless the line overrode them).
+type target struct {
+	url    string
+	weight float64
+	method string
+	body   []byte
+}
+
+// httpMethods are the methods recognised as a leading token on a
+// STDIN line, e.g. "POST https://example.com/login creds.json".
+var httpMethods = map[string]bool{
+	"GET": true, "HEAD": true, "POST": true, "PUT": true,
+	"PATCH": true, "DELETE": true, "OPTIONS": true,
+}
+
+// parseURLs reads targets from scanner, skipping blank lines. Each
+// line is one of:
+//
+//	<url>                     - uses defaultMethod and defaultBody
+//	<weight> <url>            - as above, weighted for -select weighted
+//	<METHOD> <url> [bodyfile] - method and, optionally, body from a file
+func parseURLs(scanner *bufio.Scanner, defaultMethod string, defaultBody []byte) ([]target, error) {
+	var targets []target
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+
+		t := target{url: line, weight: 1, method: defaultMethod, body: defaultBody}
+		fields := strings.Fields(line)
+
+		switch {
+		case len(fields) >= 2 && httpMethods[strings.ToUpper(fields[0])]:
+			t.method = strings.ToUpper(fields[0])
+			t.url = fields[1]
+			if len(fields) >= 3 {
+				body, err := os.ReadFile(fields[2])
+				if err != nil {
+					return nil, fmt.Errorf("reading body file %s: %w", fields[2], err)
+				}
+				t.body = body
+			}
+
+		case len(fields) == 2:
+			if w, err := strconv.ParseFloat(fields[0], 64); err == nil {
+				t.weight = w
+				t.url = fields[1]
+			}
+		}
+
+		targets = append(targets, t)
+	}
+	return targets, scanner.Err()
+}
+
+// newPicker returns a function that yields the next target to
+// request according to selectMode: random (the default, uniform),
+// weighted (proportional to each target's weight via prefix-sum
+// binary search), or roundrobin (cycles the list in order using an
+// atomic counter).
+func newPicker(selectMode string, targets []target) func() target {
+	switch selectMode {
+	case selectWeighted:
+		sums := make([]float64, len(targets))
+		var total float64
+		for i, t := range targets {
+			total += t.weight
+			sums[i] = total
+		}
+		return func() target {
+			want := rand.Float64() * total
+			i := sort.Search(len(sums), func(i int) bool { return sums[i] >= want })
+			if i >= len(targets) {
+				i = len(targets) - 1
+			}
+			return targets[i]
+		}
+
+	case selectRoundRobin:
+		var next uint64
+		return func() target {
+			i := atomic.AddUint64(&next, 1) - 1
+			return targets[i%uint64(len(targets))]
+		}
+
+	default:
+		return func() target {
+			return targets[rand.Intn(len(targets))]
+		}
+	}
+}
+
 type responseWithError struct {
-	resp *http.Response
-	err  error
+	resp   *http.Response
+	err    error
+	url    string
+	method string
+
+	start   time.Time
+	elapsed time.Duration
+	bytes   int64
+
+	dns     time.Duration
+	connect time.Duration
+	ttfb    time.Duration
+
+	expectFailed bool
+	bodyFailed   bool
+	bodyErr      string
+}
+
+// summary accumulates counts across a run so that a report can be
+// printed on exit, whether that's because the duration elapsed or
+// the user asked us to stop early.
+type summary struct {
+	total   int
+	classes map[string]int
+	errors  int
 }
 
 // Reads URLs from work channel and performs the request and sends
-// detail of response down result channel
-func worker(wg *sync.WaitGroup, work chan string,
-	result chan responseWithError, hdr, val string) {
-	for url := range work {
-		request, err := http.NewRequest("GET", url, nil)
+// detail of response down result channel. Exits early, without
+// draining the rest of work, if ctx is cancelled.
+//
+// limiter, if non-nil, is shared across all workers and is waited
+// on before every request to enforce a global requests-per-second
+// cap; delay is an additional per-worker pause applied afterwards.
+//
+// If readBody is set, up to maxBody bytes of the response body are
+// read (instead of being left for reader to discard) and, if
+// expectRe is non-nil, checked against it; a response whose body
+// doesn't match is reported as a content failure even on a 200.
+func worker(ctx context.Context, wg *sync.WaitGroup, work chan target,
+	result chan responseWithError, headers http.Header, limiter *rate.Limiter, delay time.Duration,
+	readBody bool, maxBody int64, expectRe *regexp.Regexp) {
+	defer wg.Done()
+
+	for t := range work {
+		if limiter != nil {
+			if err := limiter.Wait(ctx); err != nil {
+				return
+			}
+		}
+
+		var dnsStart, connStart time.Time
+		var dns, connect, ttfb time.Duration
+		trace := &httptrace.ClientTrace{
+			DNSStart:     func(httptrace.DNSStartInfo) { dnsStart = time.Now() },
+			DNSDone:      func(httptrace.DNSDoneInfo) { dns = time.Since(dnsStart) },
+			ConnectStart: func(string, string) { connStart = time.Now() },
+			ConnectDone:  func(string, string, error) { connect = time.Since(connStart) },
+		}
+
+		start := time.Now()
+		trace.GotFirstResponseByte = func() { ttfb = time.Since(start) }
+
+		var body io.Reader
+		if len(t.body) > 0 {
+			body = bytes.NewReader(t.body)
+		}
+
+		request, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), t.method, t.url, body)
 		if err != nil {
-			fmt.Printf("Error creating request: %s", err)
-			break
+			result <- responseWithError{
+				err: fmt.Errorf("creating request: %w", err), url: t.url, method: t.method,
+				start: start, bytes: -1,
+			}
+			continue
 		}
-		if hdr != "" {
-			request.Header.Add(hdr, val)
+		for k, vals := range headers {
+			for _, v := range vals {
+				request.Header.Add(k, v)
+			}
 		}
 		resp, err := client.Do(request)
-		result <- responseWithError{resp, err}
+
+		// bytesRead is -1 (unknown length) unless -read-body is set,
+		// in which case it's the number of bytes actually read.
+		var bytesRead int64
+		var expectFailed, bodyFailed bool
+		var bodyErr string
+		if resp != nil {
+			bytesRead = resp.ContentLength
+		}
+		if err == nil && resp != nil && readBody {
+			respBody, readErr := io.ReadAll(io.LimitReader(resp.Body, maxBody))
+			bytesRead = int64(len(respBody))
+			switch {
+			case readErr != nil:
+				bodyFailed = true
+				bodyErr = readErr.Error()
+			case expectRe != nil:
+				expectFailed = !expectRe.Match(respBody)
+			}
+		}
+
+		elapsed := time.Since(start)
+
+		result <- responseWithError{
+			resp: resp, err: err, url: t.url, method: t.method,
+			start: start, elapsed: elapsed, bytes: bytesRead,
+			dns: dns, connect: connect, ttfb: ttfb,
+			expectFailed: expectFailed, bodyFailed: bodyFailed, bodyErr: bodyErr,
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		if delay > 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+		}
 	}
+}
+
+// logRecord is the structured form of a response written in json or
+// csv logformat, one per request. Bytes is omitted/blank when the
+// byte count is unknown: a chunked or otherwise length-less response
+// reports -1 in resp.ContentLength unless -read-body was passed to
+// actually count the bytes, and propagating that -1 would silently
+// corrupt any downstream sum()/aggregate over the column.
+type logRecord struct {
+	URL       string  `json:"url"`
+	Method    string  `json:"method"`
+	Status    int     `json:"status"`
+	Bytes     *int64  `json:"bytes,omitempty"`
+	Start     string  `json:"start"`
+	ElapsedMS float64 `json:"elapsed_ms"`
+	DNSMS     float64 `json:"dns_ms"`
+	ConnectMS float64 `json:"connect_ms"`
+	TTFBMS    float64 `json:"ttfb_ms"`
+	Error     string  `json:"error"`
+}
+
+var logRecordFields = []string{
+	"url", "method", "status", "bytes", "start",
+	"elapsed_ms", "dns_ms", "connect_ms", "ttfb_ms", "error",
+}
 
-	wg.Done()
+func (r logRecord) csvRow() []string {
+	bytes := ""
+	if r.Bytes != nil {
+		bytes = fmt.Sprintf("%d", *r.Bytes)
+	}
+	return []string{
+		r.URL, r.Method, fmt.Sprintf("%d", r.Status), bytes, r.Start,
+		fmt.Sprintf("%.3f", r.ElapsedMS), fmt.Sprintf("%.3f", r.DNSMS),
+		fmt.Sprintf("%.3f", r.ConnectMS), fmt.Sprintf("%.3f", r.TTFBMS), r.Error,
+	}
 }
 
-// Just reads from the result channel and outputs values and writes
-// the log
-func reader(result chan responseWithError, log *os.File) {
+// Just reads from the result channel and outputs values, writes the
+// log, and tallies sum until the channel is closed. wg.Done() is
+// only called once every response has been drained and logged, so
+// callers can rely on sum being complete once wg.Wait() returns.
+func reader(result chan responseWithError, log *os.File, logFormat string, wg *sync.WaitGroup, sum *summary) {
+	defer wg.Done()
+
+	var csvWriter *csv.Writer
+	if log != nil && logFormat == logFormatCSV {
+		csvWriter = csv.NewWriter(log)
+		csvWriter.Write(logRecordFields)
+	}
+
 	for re := range result {
 
 		// Outputs
@@ -54,37 +326,90 @@ func reader(result chan responseWithError, log *os.File) {
 		// First character of status code (e.g. 3, 4, 5)
 
 		output := ""
-		tolog := []string{re.resp.Request.URL.String()}
+		class := "e"
+		status := 0
+		errStr := ""
 
 		switch {
 		case re.err != nil:
 			output = "e"
-			tolog = append(tolog, fmt.Sprintf("Error %s", re.err))
-		case re.resp.StatusCode == http.StatusOK:
-			output = "."
-			tolog = append(tolog, fmt.Sprintf("%s", re.resp.Status))
-			for k, v := range re.resp.Header {
-				tolog = append(tolog, fmt.Sprintf("%s: %s", k, v))
-			}
+			errStr = re.err.Error()
 		default:
-			output = re.resp.Status[0:1]
-			tolog = append(tolog, fmt.Sprintf("%s", re.resp))
+			status = re.resp.StatusCode
+			class = re.resp.Status[0:1]
+			switch {
+			case re.bodyFailed:
+				output = "b"
+				class = "b"
+				errStr = fmt.Sprintf("reading body: %s", re.bodyErr)
+			case re.expectFailed:
+				output = "x"
+				class = "x"
+				errStr = "response body did not match -expect"
+			case status == http.StatusOK:
+				output = "."
+			default:
+				output = re.resp.Status[0:1]
+			}
+			re.resp.Body.Close()
 		}
-		re.resp.Body.Close()
+
+		sum.total++
+		sum.classes[class]++
+		if re.err != nil {
+			sum.errors++
+		}
+
 		fmt.Print(output)
+
 		if log != nil {
-			tolog = append(tolog, "", "")
-			log.WriteString(strings.Join(tolog, "\n"))
+			var bytes *int64
+			if re.bytes >= 0 {
+				bytes = &re.bytes
+			}
+			rec := logRecord{
+				URL: re.url, Method: re.method, Status: status, Bytes: bytes,
+				Start:     re.start.Format(time.RFC3339Nano),
+				ElapsedMS: re.elapsed.Seconds() * 1000,
+				DNSMS:     re.dns.Seconds() * 1000,
+				ConnectMS: re.connect.Seconds() * 1000,
+				TTFBMS:    re.ttfb.Seconds() * 1000,
+				Error:     errStr,
+			}
+
+			switch logFormat {
+			case logFormatJSON:
+				line, err := json.Marshal(rec)
+				if err == nil {
+					log.Write(line)
+					log.WriteString("\n")
+				}
+			case logFormatCSV:
+				csvWriter.Write(rec.csvRow())
+				csvWriter.Flush()
+			default:
+				tolog := []string{re.url}
+				if re.err != nil {
+					tolog = append(tolog, fmt.Sprintf("Error %s", re.err))
+				} else {
+					tolog = append(tolog, fmt.Sprintf("%s", re.resp.Status))
+					for k, v := range re.resp.Header {
+						tolog = append(tolog, fmt.Sprintf("%s: %s", k, v))
+					}
+				}
+				tolog = append(tolog, "", "")
+				log.WriteString(strings.Join(tolog, "\n"))
+			}
 		}
 	}
 }
 
-// Outputs random URLs from the set of URLs until the duration
-// runs out
-func writer(work chan string, duration time.Duration, urls []string) {
-
-	// Note use of nil channel here so that if duration is infinite
-	// this function never returns
+// Outputs targets chosen by pick until the duration runs out or ctx
+// is cancelled.
+//
+// Note use of nil channel here so that if duration is infinite this
+// function never returns on its own.
+func writer(ctx context.Context, work chan target, duration time.Duration, pick func() target) {
 
 	var terminator <-chan time.Time
 	if duration > 0 {
@@ -93,31 +418,115 @@ func writer(work chan string, duration time.Duration, urls []string) {
 
 	for {
 		select {
+		case <-ctx.Done():
+			close(work)
+			return
+
 		case <-terminator:
 			close(work)
 			return
 
-		case work <- urls[rand.Intn(len(urls))]:
+		case work <- pick():
 		}
 	}
 }
 
+// printSummary reports how a run went: how many requests were made,
+// a breakdown by status class, how many hit an internal error, and
+// how long the run took. Called on a clean finish and on early exit
+// via signal so a Ctrl-C doesn't just leave the terminal blank.
+func printSummary(sum *summary, elapsed time.Duration) {
+	fmt.Printf("\n\n%d requests in %s\n", sum.total, elapsed)
+	for _, class := range []string{"1", "2", "3", "4", "5", "e", "x", "b"} {
+		n := sum.classes[class]
+		if n == 0 {
+			continue
+		}
+		switch class {
+		case "e", "x", "b":
+			fmt.Printf("  %s: %d\n", class, n)
+		default:
+			fmt.Printf("  %sxx: %d\n", class, n)
+		}
+	}
+	fmt.Printf("errors: %d\n", sum.errors)
+}
+
+// headerFlag collects repeated "-H key:value" flags, curl-style.
+type headerFlag []string
+
+func (h *headerFlag) String() string { return strings.Join(*h, ",") }
+func (h *headerFlag) Set(v string) error {
+	*h = append(*h, v)
+	return nil
+}
+
 func main() {
 	par := flag.Int("par", 10, "Number of parallel requests")
-	header := flag.String("header", "", "Optional HTTP header to insert")
 	duration := flag.Duration("duration", 0, "Optional duration; 0 = forever")
 	log := flag.String("log", "", "log file to write detailed output to")
+	logFormat := flag.String("logformat", logFormatText, "log file format: text|json|csv")
+	reqRate := flag.Float64("rate", 0, "Global requests/sec cap across all workers; 0 = unlimited")
+	delay := flag.Duration("delay", 0, "Optional per-worker delay between requests")
+	selectMode := flag.String("select", selectRandom, "URL selection mode: random|weighted|roundrobin")
+	readBody := flag.Bool("read-body", false, "Read the response body instead of discarding it")
+	maxBody := flag.Int64("max-body", 1<<20, "Maximum response body bytes to read when -read-body is set")
+	expect := flag.String("expect", "", "Regex or substring the body must contain; implies -read-body; a miss is reported as class x")
+	method := flag.String("method", "GET", "Default HTTP method for URL lines that don't specify one")
+	bodySpec := flag.String("body", "", "Default request body: a literal string, or @file to read from a file")
+	var headerFlags headerFlag
+	flag.Var(&headerFlags, "H", "Extra header 'Key: value' to add to every request (repeatable)")
 	flag.Parse()
 
-	var hdr, val string
-	if *header != "" {
-		parts := strings.SplitN(*header, " ", 2)
+	var defaultBody []byte
+	if strings.HasPrefix(*bodySpec, "@") {
+		var err error
+		defaultBody, err = os.ReadFile((*bodySpec)[1:])
+		if err != nil {
+			fmt.Printf("Error reading body file %s: %s\n", (*bodySpec)[1:], err)
+			return
+		}
+	} else if *bodySpec != "" {
+		defaultBody = []byte(*bodySpec)
+	}
+
+	headers := make(http.Header)
+	for _, h := range headerFlags {
+		parts := strings.SplitN(h, ":", 2)
 		if len(parts) != 2 {
-			fmt.Printf("Error: bad header %s\n", *header)
+			fmt.Printf("Error: bad header %s, want Key:value\n", h)
 			return
 		}
-		hdr = parts[0]
-		val = parts[1]
+		headers.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+
+	var expectRe *regexp.Regexp
+	if *expect != "" {
+		var err error
+		expectRe, err = regexp.Compile(*expect)
+		if err != nil {
+			expectRe = regexp.MustCompile(regexp.QuoteMeta(*expect))
+		}
+		*readBody = true
+	}
+
+	switch *selectMode {
+	case selectRandom, selectWeighted, selectRoundRobin:
+	default:
+		fmt.Printf("Error: bad select mode %s\n", *selectMode)
+		return
+	}
+
+	var limiter *rate.Limiter
+	if *reqRate > 0 {
+		limiter = rate.NewLimiter(rate.Limit(*reqRate), int(*par))
+	}
+
+	switch *logFormat {
+	case logFormatText, logFormatJSON, logFormatCSV:
+	default:
+		fmt.Printf("Error: bad logformat %s\n", *logFormat)
+		return
 	}
 
 	var logger *os.File
@@ -130,38 +539,50 @@ func main() {
 		}
 	}
 
-	var urls []string
-
-	scanner := bufio.NewScanner(os.Stdin)
-	for scanner.Scan() {
-		url := scanner.Text()
-		if url != "" {
-			urls = append(urls, url)
-		}
+	targets, err := parseURLs(bufio.NewScanner(os.Stdin), *method, defaultBody)
+	if err != nil {
+		fmt.Printf("Error reading URLs: %s\n", err)
+		return
 	}
-
-	if len(urls) == 0 {
+	if len(targets) == 0 {
 		fmt.Printf("Error: no URLs found")
 		return
 	}
+	pick := newPicker(*selectMode, targets)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		cancel()
+	}()
 
-	work := make(chan string)
+	work := make(chan target)
 	result := make(chan responseWithError)
 
-	var wg sync.WaitGroup
+	var workerWg sync.WaitGroup
 	for i := 0; i < *par; i++ {
-		wg.Add(1)
-		go worker(&wg, work, result, hdr, val)
+		workerWg.Add(1)
+		go worker(ctx, &workerWg, work, result, headers, limiter, *delay, *readBody, *maxBody, expectRe)
 	}
 
-	go writer(work, *duration, urls)
-	go reader(result, logger)
+	sum := &summary{classes: make(map[string]int)}
+	var readerWg sync.WaitGroup
+	readerWg.Add(1)
+	go reader(result, logger, *logFormat, &readerWg, sum)
 
-	wg.Wait()
+	start := time.Now()
+	go writer(ctx, work, *duration, pick)
+
+	workerWg.Wait()
 	close(result)
+	readerWg.Wait()
+
 	if logger != nil {
 		logger.Close()
 	}
+	signal.Stop(sigCh)
 
-	fmt.Printf("\n")
-}
\ No newline at end of file
+	printSummary(sum, time.Since(start))
+}